@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// runDiscover generates a TLSxResults set from crt.sh/CT logs, reverse DNS
+// over a CIDR, and an optional DNS wordlist brute force, deduplicating SANs
+// across all three sources. It writes them in the same "host [san]" line
+// format the normal scanning path already parses, so that path is unchanged.
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	domain := fs.String("domain", "", "Seed domain to query crt.sh / CT logs and brute force against")
+	cidr := fs.String("cidr", "", "CIDR range to reverse-resolve for PTR-derived SANs")
+	wordlist := fs.String("wordlist", "", "Wordlist file for DNS brute force subdomains (requires -domain)")
+	out := fs.String("o", "", "Output file in tlsx-compatible format (default: stdout)")
+	fs.Parse(args)
+
+	if *domain == "" && *cidr == "" {
+		return fmt.Errorf("discover: at least one of -domain or -cidr is required")
+	}
+
+	seen := make(map[string]map[string]struct{}) // host -> set of SAN
+	addSAN := func(host, san string) {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		san = strings.ToLower(strings.TrimSuffix(san, "."))
+		if host == "" || san == "" {
+			return
+		}
+		if seen[host] == nil {
+			seen[host] = make(map[string]struct{})
+		}
+		seen[host][san] = struct{}{}
+	}
+
+	if *domain != "" {
+		sans, err := queryCTLogs(*domain)
+		if err != nil {
+			log.Printf("crt.sh query for %s failed: %v", *domain, err)
+		}
+		for _, san := range sans {
+			addSAN(*domain, san)
+		}
+
+		if *wordlist != "" {
+			for _, san := range bruteForceDNS(*domain, *wordlist) {
+				addSAN(*domain, san)
+			}
+		}
+	}
+
+	if *cidr != "" {
+		for _, r := range reverseIPSANs(*cidr) {
+			for _, san := range r.SAN {
+				addSAN(r.Host, san)
+			}
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		fh, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		w = fh
+	}
+
+	for host, sans := range seen {
+		for san := range sans {
+			fmt.Fprintf(w, "%s [%s]\n", host, san)
+		}
+	}
+
+	return nil
+}
+
+// crtShEntry mirrors the fields we care about in crt.sh's JSON output.
+type crtShEntry struct {
+	NameValue string `json:"name_value"`
+}
+
+// queryCTLogs fetches certificate transparency log entries for domain from
+// crt.sh and returns the deduplicated set of SANs found across them.
+func queryCTLogs(domain string) ([]string, error) {
+	resp, err := http.Get(fmt.Sprintf("https://crt.sh/?q=%%25.%s&output=json", url.QueryEscape(domain)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("crt.sh returned %s", resp.Status)
+	}
+
+	var entries []crtShEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	var sans []string
+	for _, e := range entries {
+		for _, name := range strings.Split(e.NameValue, "\n") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			sans = append(sans, name)
+		}
+	}
+
+	return sans, nil
+}
+
+// bruteForceDNS resolves domain with every word in wordlistPath prepended as
+// a subdomain label and returns the ones that resolve.
+func bruteForceDNS(domain, wordlistPath string) []string {
+	f, err := os.Open(wordlistPath)
+	if err != nil {
+		log.Printf("could not open wordlist %q: %v", wordlistPath, err)
+		return nil
+	}
+	defer f.Close()
+
+	var found []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" {
+			continue
+		}
+
+		candidate := word + "." + domain
+		if _, err := net.LookupHost(candidate); err == nil {
+			found = append(found, candidate)
+		}
+	}
+
+	return found
+}
+
+// reverseIPSANs walks every address in cidr, resolves its PTR record, and
+// returns one TLSxResults entry per address that has one.
+func reverseIPSANs(cidr string) []TLSxResults {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		log.Printf("invalid -cidr %q: %v", cidr, err)
+		return nil
+	}
+
+	var results []TLSxResults
+	for ip := cloneIP(ipnet.IP); ipnet.Contains(ip); incIP(ip) {
+		names, err := net.LookupAddr(ip.String())
+		if err != nil || len(names) == 0 {
+			continue
+		}
+
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			results = append(results, TLSxResults{
+				Host: name,
+				IP:   []string{ip.String()},
+				SAN:  []string{name},
+			})
+		}
+	}
+
+	return results
+}
+
+func cloneIP(ip net.IP) net.IP {
+	dup := make(net.IP, len(ip))
+	copy(dup, ip)
+	return dup
+}
+
+func incIP(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] != 0 {
+			break
+		}
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,37 +35,379 @@ type Results struct {
 	Title           string `json:"Title"`
 	ResponseHeaders []string
 	ResponseBody    string `json:"ResponseBody,omitempty"`
+	Protocol        string `json:"Protocol,omitempty"` // negotiated ALPN protocol, e.g. "h2" or "http/1.1"
+	TLSVersion      string `json:"TLSVersion,omitempty"`
+	CipherSuite     string `json:"CipherSuite,omitempty"`
+	RequiresAuth    bool   `json:"RequiresAuth,omitempty"`  // true if the response was 401/403 rather than authenticated
+	Authenticated   bool   `json:"Authenticated,omitempty"` // true if -auth was in use and got a 200
+}
+
+// Auth applies a credential to an outgoing probe, either on the HTTP request
+// itself or (for client certificates) the TLS handshake that precedes it.
+type Auth interface {
+	Apply(req *http.Request) error
+	TLSCertificate() (*tls.Certificate, error)
+}
+
+// noneAuth is the default: probe unauthenticated, as the tool always has.
+type noneAuth struct{}
+
+func (noneAuth) Apply(*http.Request) error                 { return nil }
+func (noneAuth) TLSCertificate() (*tls.Certificate, error) { return nil, nil }
+
+type basicAuth struct {
+	user, pass string
+}
+
+func (a basicAuth) Apply(req *http.Request) error {
+	req.SetBasicAuth(a.user, a.pass)
+	return nil
+}
+func (basicAuth) TLSCertificate() (*tls.Certificate, error) { return nil, nil }
+
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) Apply(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+func (bearerAuth) TLSCertificate() (*tls.Certificate, error) { return nil, nil }
+
+type headerAuth struct {
+	name, value string
+}
+
+func (a headerAuth) Apply(req *http.Request) error {
+	req.Header.Set(a.name, a.value)
+	return nil
+}
+func (headerAuth) TLSCertificate() (*tls.Certificate, error) { return nil, nil }
+
+// certAuth presents a client certificate during the TLS handshake; it adds
+// nothing to the HTTP request itself.
+type certAuth struct {
+	cert tls.Certificate
+}
+
+func newCertAuth(certFile, keyFile string) (certAuth, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return certAuth{}, fmt.Errorf("could not load client certificate: %w", err)
+	}
+	return certAuth{cert: cert}, nil
+}
+
+func (certAuth) Apply(*http.Request) error                   { return nil }
+func (a certAuth) TLSCertificate() (*tls.Certificate, error) { return &a.cert, nil }
+
+// parseAuth parses an -auth flag value of the form "scheme:params" into an
+// Auth implementation. An empty spec or "none" disables authentication.
+func parseAuth(spec string) (Auth, error) {
+	if spec == "" || spec == "none" {
+		return noneAuth{}, nil
+	}
+
+	scheme, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid -auth value %q: expected scheme:params", spec)
+	}
+
+	switch scheme {
+	case "basic":
+		user, pass, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid -auth value %q: expected basic:user:pass", spec)
+		}
+		return basicAuth{user: user, pass: pass}, nil
+	case "bearer":
+		return bearerAuth{token: rest}, nil
+	case "header":
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -auth value %q: expected header:Name=Value", spec)
+		}
+		return headerAuth{name: name, value: value}, nil
+	case "cert":
+		certFile, keyFile, ok := strings.Cut(rest, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid -auth value %q: expected cert:cert.pem,key.pem", spec)
+		}
+		return newCertAuth(certFile, keyFile)
+	default:
+		return nil, fmt.Errorf("unknown -auth scheme %q", scheme)
+	}
 }
 
 type Flags struct {
 	file        string
 	verbose     bool
 	includeBody bool
+	concurrency int
+	rps         float64
+	http1Only   bool
+	logFile     string
+	logFormat   string
+	auth        string
+	retries     int
+	backoff     time.Duration
+	dialTimeout time.Duration
+	tlsTimeout  time.Duration
+	respTimeout time.Duration
+	resume      string
 }
 
-var (
-	finalResults sync.Map
-	flags        Flags
-	clientPool   sync.Pool
-)
+// probeLogEntry records a single probe attempt, successful or not, independent
+// of whether it ends up in the "interesting" results file.
+type probeLogEntry struct {
+	Host    string  `json:"host"`
+	IP      string  `json:"ip"`
+	SNI     string  `json:"sni"`
+	Status  string  `json:"status,omitempty"`
+	Bytes   int     `json:"bytes,omitempty"`
+	Elapsed float64 `json:"elapsed_seconds"`
+	Error   string  `json:"error,omitempty"`
+}
 
-func checkVHost(dialer *net.Dialer, s string, i string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// requestLogger streams probeLogEntry records to disk as they happen, guarded
+// by a mutex since every worker writes to the same file. A nil *requestLogger
+// is a no-op so callers don't need to branch on -log being unset.
+type requestLogger struct {
+	mu     sync.Mutex
+	file   *os.File
+	format string
+}
 
-	conn, err := tls.DialWithDialer(dialer, "tcp", i+":443", &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         s,
-	})
+func newRequestLogger(path, format string) (*requestLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
 
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		if flags.verbose {
-			log.Printf("Could not connect to %s: %v\n", s, err)
+		return nil, err
+	}
+
+	return &requestLogger{file: f, format: format}, nil
+}
+
+func (l *requestLogger) log(e probeLogEntry) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.format == "apache" {
+		// True Apache Combined Log Format:
+		// %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+		// This tool has no referer/user-agent of its own to report, and a
+		// failed probe has no status line, so both become "-" per CLF
+		// convention. Elapsed time and probe errors aren't part of Combined
+		// format at all; use -log-format jsonl to capture those.
+		status := "-"
+		bytes := "-"
+		if fields := strings.Fields(e.Status); len(fields) > 0 {
+			status = fields[0]
+			bytes = strconv.Itoa(e.Bytes)
 		}
+
+		fmt.Fprintf(l.file, "%s - - [%s] \"GET / HTTP/1.1\" %s %s \"-\" \"-\"\n",
+			e.IP, time.Now().Format("02/Jan/2006:15:04:05 -0700"), status, bytes)
 		return
 	}
-	defer conn.Close()
+
+	if err := json.NewEncoder(l.file).Encode(e); err != nil {
+		log.Printf("Could not write log entry: %v", err)
+	}
+}
+
+func (l *requestLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// resultsWriter streams each interesting Results record to disk as NDJSON as
+// soon as it's found, rather than buffering everything in memory for a
+// batched write at the end, so a crash mid-scan doesn't lose prior progress.
+type resultsWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newResultsWriter(path string) (*resultsWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &resultsWriter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (w *resultsWriter) write(r Results) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(r); err != nil {
+		log.Printf("Could not write result: %v", err)
+	}
+}
+
+func (w *resultsWriter) Close() error {
+	return w.file.Close()
+}
+
+// resumeKey identifies a (SAN, IP) pair as already probed, for skipping on resume.
+func resumeKey(san, ip string) string {
+	return san + "|" + ip
+}
+
+// loadResumeSkipSet reads a prior run's results NDJSON file (the vhosts_*.json
+// a normal scan always produces) and returns the set of (SAN, IP) pairs it
+// already covers, so a resumed scan doesn't re-probe them. Since that file
+// only contains the interesting hits, not every attempt, a resumed scan will
+// still re-probe vhosts that were uninteresting last time; that's considered
+// acceptable since it avoids requiring a prior -log-format jsonl run just to
+// resume.
+func loadResumeSkipSet(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	skip := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var r Results
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("could not parse -resume entry %q: %w", line, err)
+		}
+
+		if r.Host == "" || r.IP == "" {
+			return nil, fmt.Errorf("-resume file %q: entry missing Host/IP fields %q; -resume expects a prior vhosts_*.json results file", path, line)
+		}
+
+		skip[resumeKey(r.Host, r.IP)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(skip) == 0 {
+		log.Printf("-resume file %q contained no entries; nothing will be skipped\n", path)
+	}
+
+	return skip, nil
+}
+
+// vhostJob is a single (SAN, IP) pair queued for the worker pool.
+type vhostJob struct {
+	san string
+	ip  string
+}
+
+// rateLimiter throttles callers to at most one tick per interval. A nil
+// *rateLimiter is a no-op, so callers don't need to branch on -rps being unset.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+
+	interval := time.Duration(float64(time.Second) / rps)
+	if interval <= 0 {
+		// rps so large the computed interval underflows to 0, which would
+		// make time.NewTicker panic; a 1ns tick is effectively unlimited.
+		interval = time.Nanosecond
+	}
+
+	return &rateLimiter{ticker: time.NewTicker(interval)}
+}
+
+func (r *rateLimiter) wait() {
+	if r == nil {
+		return
+	}
+	<-r.ticker.C
+}
+
+func (r *rateLimiter) Stop() {
+	if r == nil {
+		return
+	}
+	r.ticker.Stop()
+}
+
+var (
+	flags      Flags
+	clientPool sync.Pool
+)
+
+// alpnProtocols returns the ALPN protocol preference list for the TLS
+// handshake, honouring -http1-only.
+func alpnProtocols() []string {
+	if flags.http1Only {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// isRetryable reports whether err is likely transient (I/O timeout, TLS
+// handshake reset, DNS lookup timeout) rather than terminal (NXDOMAIN).
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backoffDuration returns the exponential backoff delay for the given
+// zero-based retry attempt, with up to 50% jitter added on top.
+func backoffDuration(attempt int) time.Duration {
+	d := flags.backoff
+	for n := 0; n < attempt; n++ {
+		d *= 2
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// probeAttempt performs a single dial/request/read cycle against s/i and logs
+// it via logger. retryable tells the caller whether it's worth trying again.
+func probeAttempt(dialer *net.Dialer, s string, i string, limiter *rateLimiter, logger *requestLogger, auth Auth) (resp *http.Response, body []byte, err error, retryable bool) {
+	limiter.wait()
+
+	start := time.Now()
+	entry := probeLogEntry{Host: s, IP: i, SNI: s}
+	defer func() {
+		entry.Elapsed = time.Since(start).Seconds()
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		logger.log(entry)
+	}()
 
 	client := clientPool.Get().(*http.Client)
+	defer clientPool.Put(client)
 	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		if addr == s+":443" {
 			addr = i + ":443"
@@ -75,31 +420,81 @@ func checkVHost(dialer *net.Dialer, s string, i string, wg *sync.WaitGroup) {
 		if flags.verbose {
 			log.Printf("Could not create request: %v", err)
 		}
-		return
+		return nil, nil, err, false
 	}
 
 	httpReq.Host = s
 
-	resp, err := client.Do(httpReq)
+	if err = auth.Apply(httpReq); err != nil {
+		if flags.verbose {
+			log.Printf("Could not apply auth to request for %s: %v", s, err)
+		}
+		return nil, nil, err, false
+	}
+
+	resp, err = client.Do(httpReq)
 	if err != nil {
 		if flags.verbose {
 			log.Printf("Could not send request: %v", err)
 		}
-		return
+		return nil, nil, err, isRetryable(err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	entry.Status = resp.Status
+
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		if flags.verbose {
 			log.Printf("Could not read response: %v", err)
 		}
+		return nil, nil, err, isRetryable(err)
+	}
+
+	entry.Bytes = len(body)
+
+	if resp.StatusCode >= 500 {
+		// Still return resp/body alongside the error: checkVHost retries on
+		// it, but falls back to this response rather than dropping the
+		// finding if every attempt keeps 5xx-ing.
+		err = fmt.Errorf("server error: %s", resp.Status)
+		return resp, body, err, true
+	}
+
+	return resp, body, nil, false
+}
+
+func checkVHost(dialer *net.Dialer, s string, i string, limiter *rateLimiter, logger *requestLogger, auth Auth, results *resultsWriter) {
+	var (
+		resp *http.Response
+		body []byte
+		err  error
+	)
+
+	for attempt := 0; attempt <= flags.retries; attempt++ {
+		var retryable bool
+		resp, body, err, retryable = probeAttempt(dialer, s, i, limiter, logger, auth)
+		if err == nil || !retryable || attempt == flags.retries {
+			break
+		}
+
+		if flags.verbose {
+			log.Printf("Retrying %s (%s) after attempt %d: %v\n", s, i, attempt+1, err)
+		}
+		time.Sleep(backoffDuration(attempt))
+	}
+
+	if resp == nil {
 		return
 	}
 
+	requiresAuth := resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+	_, noAuth := auth.(noneAuth)
+	authenticated := !noAuth && resp.StatusCode == http.StatusOK
+
 	if body != nil {
-		_, err = net.LookupIP(s)
-		if err != nil {
+		_, dnsErr := net.LookupIP(s)
+		if dnsErr != nil || requiresAuth || authenticated {
 			color.Green("Interesting Vhost: %s: %s\n", s, i)
 
 			title := ""
@@ -120,29 +515,107 @@ func checkVHost(dialer *net.Dialer, s string, i string, wg *sync.WaitGroup) {
 				IP:              i,
 				Title:           title,
 				ResponseHeaders: respHeaders,
+				RequiresAuth:    requiresAuth,
+				Authenticated:   authenticated,
+			}
+
+			if resp.TLS != nil {
+				result.Protocol = resp.TLS.NegotiatedProtocol
+				result.TLSVersion = tls.VersionName(resp.TLS.Version)
+				result.CipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
 			}
 
 			if flags.includeBody {
 				result.ResponseBody = string(body)
 			}
 
-			finalResults.Store(s, result)
+			results.write(result)
 		}
 	}
-	clientPool.Put(client)
 }
 
 func main() {
-	// Todo: add concurrency flag
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		if err := runDiscover(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	flag.StringVar(&flags.file, "f", "", "File to read from")
 	flag.BoolVar(&flags.verbose, "v", false, "Show verbose errors")
 	flag.BoolVar(&flags.includeBody, "b", false, "Include the Body of the response in the output")
+	flag.IntVar(&flags.concurrency, "c", 20, "Maximum number of concurrent vhost checks")
+	flag.Float64Var(&flags.rps, "rps", 0, "Maximum requests per second across all workers (0 = unlimited)")
+	flag.BoolVar(&flags.http1Only, "http1-only", false, "Disable HTTP/2 ALPN negotiation and speak HTTP/1.1 only")
+	flag.StringVar(&flags.logFile, "log", "", "Stream every probe attempt to this file, independent of the results file")
+	flag.StringVar(&flags.logFormat, "log-format", "jsonl", "Format for -log: jsonl or apache")
+	flag.StringVar(&flags.auth, "auth", "none", "Auth to present to each vhost: none, basic:user:pass, bearer:token, header:Name=Value, cert:cert.pem,key.pem")
+	flag.IntVar(&flags.retries, "retries", 2, "Number of retries for transient dial/TLS/HTTP failures")
+	flag.DurationVar(&flags.backoff, "backoff", 500*time.Millisecond, "Base backoff between retries, doubled each attempt plus jitter")
+	flag.DurationVar(&flags.dialTimeout, "dial-timeout", 10*time.Second, "Timeout for the initial TCP dial")
+	flag.DurationVar(&flags.tlsTimeout, "tls-timeout", 10*time.Second, "Timeout for the TLS handshake")
+	flag.DurationVar(&flags.respTimeout, "response-timeout", 15*time.Second, "Timeout for the full HTTP round trip")
+	flag.StringVar(&flags.resume, "resume", "", "Prior vhosts_*.json results file; (SAN, IP) pairs it already covers are skipped")
 	flag.Parse()
 
 	if flags.file == "" {
 		log.Fatal("No file specified")
 	}
 
+	if flags.concurrency < 1 {
+		log.Fatal("-c must be at least 1")
+	}
+
+	if flags.logFormat != "jsonl" && flags.logFormat != "apache" {
+		log.Fatal("-log-format must be jsonl or apache")
+	}
+
+	reqLogger, err := newRequestLogger(flags.logFile, flags.logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reqLogger.Close()
+
+	auth, err := parseAuth(flags.auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var resumeSkip map[string]struct{}
+	if flags.resume != "" {
+		resumeSkip, err = loadResumeSkipSet(flags.resume)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var clientCerts []tls.Certificate
+	if cert, err := auth.TLSCertificate(); err != nil {
+		log.Fatal(err)
+	} else if cert != nil {
+		clientCerts = []tls.Certificate{*cert}
+	}
+
+	clientPool = sync.Pool{
+		New: func() interface{} {
+			return &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: true,
+						NextProtos:         alpnProtocols(),
+						Certificates:       clientCerts,
+					},
+					ForceAttemptHTTP2:   !flags.http1Only,
+					MaxIdleConns:        flags.concurrency * 2,
+					MaxIdleConnsPerHost: flags.concurrency,
+					TLSHandshakeTimeout: flags.tlsTimeout,
+				},
+				Timeout: flags.respTimeout,
+			}
+		},
+	}
+
 	file, err := os.Open(flags.file)
 	if err != nil {
 		log.Fatal(err)
@@ -201,8 +674,34 @@ func main() {
 		log.Fatal(err)
 	}
 
+	dialer := &net.Dialer{
+		Timeout:   flags.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	limiter := newRateLimiter(flags.rps)
+	defer limiter.Stop()
+
+	writeFilename := fmt.Sprintf("vhosts_%s.json", time.Now().Format("2006-01-02_15-04-05"))
+	results, err := newResultsWriter(writeFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer results.Close()
+
+	jobs := make(chan vhostJob)
 	var wg sync.WaitGroup
 
+	for w := 0; w < flags.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				checkVHost(dialer, job.san, job.ip, limiter, reqLogger, auth, results)
+			}
+		}()
+	}
+
+	var skipped int
 	for _, t := range tlsxResults {
 		host := strings.ReplaceAll(strings.ReplaceAll(t.Host, "https://", ""), ":443", "")
 		ip, err := net.LookupIP(host)
@@ -217,55 +716,26 @@ func main() {
 			t.IP = append(t.IP, i.String())
 		}
 
-		dialer := &net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}
-
 		for _, s := range t.SAN {
 			for _, i := range t.IP {
-				wg.Add(1)
-				// Todo: use concurrency flag for how many goroutines to run
-				go checkVHost(dialer, s, i, &wg)
+				if _, done := resumeSkip[resumeKey(s, i)]; done {
+					skipped++
+					continue
+				}
+
+				// Sending blocks until a worker is free, so excess input
+				// queues instead of spawning unbounded goroutines.
+				jobs <- vhostJob{san: s, ip: i}
 			}
 		}
 	}
 
+	close(jobs)
 	wg.Wait()
 
-	writeFilename := fmt.Sprintf("vhosts_%s.json", time.Now().Format("2006-01-02_15-04-05"))
-	fh, err := os.Create(writeFilename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer fh.Close()
-
-	enc := json.NewEncoder(fh)
-	finalResults.Range(func(key, value interface{}) bool {
-		err := enc.Encode(value)
-		if err != nil {
-			log.Printf("Could not encode JSON: %v", err)
-		}
-		return true
-	})
-
-	if err != nil {
-		log.Fatal(err)
+	if flags.resume != "" {
+		log.Printf("Skipped %d already-probed (SAN, IP) pairs from %s\n", skipped, flags.resume)
 	}
 
 	color.Green("Results written to %s\n", writeFilename)
 }
-
-func init() {
-	clientPool = sync.Pool{
-		New: func() interface{} {
-			return &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						InsecureSkipVerify: true,
-					},
-				},
-			}
-		},
-	}
-}